@@ -0,0 +1,9 @@
+package protocol
+
+import "github.com/metacubex/quic-go/http3"
+
+// FrameTypePing is an explicit application-layer heartbeat. A client with no TCP/UDP
+// traffic to otherwise keep a session's activity timer alive may open a bidirectional
+// stream whose first frame has this type instead; the server resets the idle timer on
+// receipt and closes the stream without responding.
+const FrameTypePing http3.FrameType = 0x402
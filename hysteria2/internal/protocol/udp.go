@@ -0,0 +1,48 @@
+package protocol
+
+import "encoding/binary"
+
+// UDPMessage is a single UDP datagram relayed over a QUIC unreliable datagram frame,
+// tagged with the session ID the client chose for it so multiple UDP "connections"
+// can share one QUIC connection's datagrams.
+type UDPMessage struct {
+	SessionID uint32
+	PacketID  uint16
+	FragID    uint8
+	FragCount uint8
+	Addr      string
+	Data      []byte
+}
+
+// WriteUDPMessage serializes m into a buffer suitable for quic.Conn.SendDatagram.
+func WriteUDPMessage(m UDPMessage) []byte {
+	buf := make([]byte, 10+len(m.Addr)+len(m.Data))
+	binary.BigEndian.PutUint32(buf[0:4], m.SessionID)
+	binary.BigEndian.PutUint16(buf[4:6], m.PacketID)
+	buf[6] = m.FragID
+	buf[7] = m.FragCount
+	binary.BigEndian.PutUint16(buf[8:10], uint16(len(m.Addr)))
+	n := copy(buf[10:], m.Addr)
+	copy(buf[10+n:], m.Data)
+	return buf
+}
+
+// ParseUDPMessage parses b as produced by WriteUDPMessage, returning false if it is too
+// short to be a validly framed message.
+func ParseUDPMessage(b []byte) (UDPMessage, bool) {
+	if len(b) < 10 {
+		return UDPMessage{}, false
+	}
+	addrLen := int(binary.BigEndian.Uint16(b[8:10]))
+	if len(b) < 10+addrLen {
+		return UDPMessage{}, false
+	}
+	return UDPMessage{
+		SessionID: binary.BigEndian.Uint32(b[0:4]),
+		PacketID:  binary.BigEndian.Uint16(b[4:6]),
+		FragID:    b[6],
+		FragCount: b[7],
+		Addr:      string(b[10 : 10+addrLen]),
+		Data:      b[10+addrLen:],
+	}, true
+}
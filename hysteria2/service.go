@@ -9,6 +9,7 @@ import (
 	"os"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	tls "github.com/metacubex/utls"
@@ -27,6 +28,17 @@ import (
 	N "github.com/metacubex/sing/common/network"
 )
 
+// DefaultAuthTimeout is how long a QUIC connection may stay open without completing
+// the auth POST before Service closes it, unless ServiceOptions.AuthTimeout overrides it.
+const DefaultAuthTimeout = 10 * time.Second
+
+// PortRange is an inclusive range of UDP ports, used to bind additional sockets for
+// Hysteria2 port hopping.
+type PortRange struct {
+	Start uint16
+	End   uint16
+}
+
 type ServiceOptions struct {
 	Context               context.Context
 	Logger                logger.Logger
@@ -34,15 +46,48 @@ type ServiceOptions struct {
 	SendBPS               uint64
 	ReceiveBPS            uint64
 	IgnoreClientBandwidth bool
-	SalamanderPassword    string
-	TLSConfig             *tls.Config
-	QUICConfig            *quic.Config
-	UDPDisabled           bool
-	UDPTimeout            time.Duration
-	Handler               ServerHandler
-	MasqueradeHandler     http.Handler
-	CWND                  int
-	UdpMTU                int
+	// SalamanderPassword is equivalent to Obfuscation = ObfuscationOptions{Type:
+	// "salamander", Password: SalamanderPassword}, kept for backwards compatibility.
+	// Obfuscation takes precedence when both are set.
+	SalamanderPassword string
+	// Obfuscation configures packet-level obfuscation applied below QUIC/TLS, e.g.
+	// Salamander or XPlus.
+	Obfuscation       ObfuscationOptions
+	TLSConfig         *tls.Config
+	QUICConfig        *quic.Config
+	UDPDisabled       bool
+	UDPTimeout        time.Duration
+	Handler           ServerHandler
+	MasqueradeHandler http.Handler
+	CWND              int
+	UdpMTU            int
+	// AuthTimeout bounds how long a QUIC connection may stay open without completing
+	// the Hysteria2 auth POST, to protect against idle or probing clients. Defaults to
+	// 10 seconds; a negative value disables the timeout.
+	AuthTimeout time.Duration
+	// PortRanges, when non-empty, makes Start bind one additional UDP socket per port
+	// in the ranges (besides the socket passed to Start) and accept QUIC traffic across
+	// all of them as a single logical listener, for Hysteria2-style "port hopping".
+	PortRanges []PortRange
+	// HopInterval, when set alongside PortRanges, rotates which subset of the bound
+	// ports is considered "active" for server-generated URLs; see Service.ActivePorts.
+	HopInterval time.Duration
+	// TrafficTracker, when set, is notified of per-user traffic and may reject new
+	// connections, for quotas and live usage reporting.
+	TrafficTracker TrafficTracker
+	// Heartbeat, when set, closes a session if it sees no stream, datagram or
+	// protocol.FrameTypePing activity for 2*Heartbeat, on top of QUIC's own
+	// KeepAlivePeriod/MaxIdleTimeout.
+	Heartbeat time.Duration
+	// ZeroRTTHandshake accepts connections via qtls.ListenEarly instead of qtls.Listen,
+	// so the auth POST (and even an initial TCP request) can arrive as 0-RTT data
+	// before the TLS handshake finishes, reducing handshake latency.
+	//
+	// 0-RTT data is replayable by an attacker who captures it: the auth POST is safe to
+	// replay since it only looks up userMap, but handleStream refuses to hand a stream
+	// to Handler until the handshake completes, so a replayed TCP request cannot open a
+	// duplicate connection to the destination.
+	ZeroRTTHandshake bool
 }
 
 type ServerHandler interface {
@@ -50,6 +95,17 @@ type ServerHandler interface {
 	N.UDPConnectionHandler
 }
 
+// TrafficTracker lets a caller account for and gate per-user traffic. User is whatever
+// comparable type was passed to NewService, boxed as any since ServiceOptions itself
+// isn't generic. PushTx/PushRx are called for every stream write/read and datagram
+// send/receive after authentication; AllowNewConnection is called before a new TCP
+// stream is handed to Handler, so it can reject connections once a quota is exhausted.
+type TrafficTracker interface {
+	PushTx(user any, n int)
+	PushRx(user any, n int)
+	AllowNewConnection(user any) error
+}
+
 type Service[U comparable] struct {
 	ctx                   context.Context
 	logger                logger.Logger
@@ -57,7 +113,7 @@ type Service[U comparable] struct {
 	sendBPS               uint64
 	receiveBPS            uint64
 	ignoreClientBandwidth bool
-	salamanderPassword    string
+	obfuscator            Obfuscator
 	tlsConfig             *tls.Config
 	quicConfig            *quic.Config
 	userMap               map[string]U
@@ -68,6 +124,20 @@ type Service[U comparable] struct {
 	quicListener          io.Closer
 	cwnd                  int
 	udpMTU                int
+	authTimeout           time.Duration
+	portRanges            []PortRange
+	hopInterval           time.Duration
+	trafficTracker        TrafficTracker
+	heartbeat             time.Duration
+	zeroRTTHandshake      bool
+
+	listenAccess sync.Mutex
+	listenPorts  []uint16
+	activePorts  []uint16
+	hopDone      chan struct{}
+
+	sessionAccess sync.Mutex
+	sessions      map[*serverSession[U]]struct{}
 }
 
 func NewService[U comparable](options ServiceOptions) (*Service[U], error) {
@@ -102,9 +172,21 @@ func NewService[U comparable](options ServiceOptions) (*Service[U], error) {
 	if options.MasqueradeHandler == nil {
 		options.MasqueradeHandler = http.NotFoundHandler()
 	}
+	if options.AuthTimeout == 0 {
+		options.AuthTimeout = DefaultAuthTimeout
+	} else if options.AuthTimeout < 0 {
+		options.AuthTimeout = 0
+	}
 	if len(options.TLSConfig.NextProtos) == 0 {
 		options.TLSConfig.NextProtos = []string{http3.NextProtoH3}
 	}
+	if options.Obfuscation.Type == "" && options.SalamanderPassword != "" {
+		options.Obfuscation = ObfuscationOptions{Type: "salamander", Password: options.SalamanderPassword}
+	}
+	obfuscator, err := NewObfuscator(options.Obfuscation)
+	if err != nil {
+		return nil, err
+	}
 	return &Service[U]{
 		ctx:                   options.Context,
 		logger:                options.Logger,
@@ -112,7 +194,7 @@ func NewService[U comparable](options ServiceOptions) (*Service[U], error) {
 		sendBPS:               options.SendBPS,
 		receiveBPS:            options.ReceiveBPS,
 		ignoreClientBandwidth: options.IgnoreClientBandwidth,
-		salamanderPassword:    options.SalamanderPassword,
+		obfuscator:            obfuscator,
 		tlsConfig:             options.TLSConfig,
 		quicConfig:            quicConfig,
 		userMap:               make(map[string]U),
@@ -122,6 +204,13 @@ func NewService[U comparable](options ServiceOptions) (*Service[U], error) {
 		masqueradeHandler:     options.MasqueradeHandler,
 		cwnd:                  options.CWND,
 		udpMTU:                options.UdpMTU,
+		authTimeout:           options.AuthTimeout,
+		portRanges:            options.PortRanges,
+		hopInterval:           options.HopInterval,
+		trafficTracker:        options.TrafficTracker,
+		heartbeat:             options.Heartbeat,
+		zeroRTTHandshake:      options.ZeroRTTHandshake,
+		sessions:              make(map[*serverSession[U]]struct{}),
 	}, nil
 }
 
@@ -134,23 +223,137 @@ func (s *Service[U]) UpdateUsers(userList []U, passwordList []string) {
 }
 
 func (s *Service[U]) Start(conn net.PacketConn) error {
-	if s.salamanderPassword != "" {
-		conn = NewSalamanderConn(conn, []byte(s.salamanderPassword))
-	}
 	err := qtls.ConfigureHTTP3(s.tlsConfig)
 	if err != nil {
 		return err
 	}
-	listener, err := qtls.Listen(conn, s.tlsConfig, s.quicConfig)
+	var listener qtls.Listener
+	if len(s.portRanges) > 0 {
+		listener, err = s.startPortHopping(conn)
+	} else {
+		conn = NewObfuscatorConn(conn, s.obfuscator)
+		s.listenPorts = []uint16{localPort(conn)}
+		if s.zeroRTTHandshake {
+			listener, err = qtls.ListenEarly(conn, s.tlsConfig, s.quicConfig)
+		} else {
+			listener, err = qtls.Listen(conn, s.tlsConfig, s.quicConfig)
+		}
+	}
 	if err != nil {
 		return err
 	}
 	s.quicListener = listener
+	s.activePorts = s.listenPorts
+	if s.hopInterval > 0 && len(s.listenPorts) > 1 {
+		s.hopDone = make(chan struct{})
+		go s.loopHop()
+	}
 	go s.loopConnections(listener)
 	return nil
 }
 
+// startPortHopping binds one extra UDP socket per configured port (besides conn, which
+// is kept as-is) and merges all of them into a single QUIC listener via
+// qtls.MultiPortListen, so a client can freely change which port it sends to or from.
+func (s *Service[U]) startPortHopping(conn net.PacketConn) (qtls.Listener, error) {
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		return nil, E.New("port hopping requires conn to be a *net.UDPConn")
+	}
+	localAddr, ok := udpConn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil, E.New("port hopping requires a UDP local address")
+	}
+	for _, portRange := range s.portRanges {
+		if portRange.Start > portRange.End {
+			return nil, E.New("invalid port range: start ", portRange.Start, " is after end ", portRange.End)
+		}
+	}
+	seenPorts := map[uint16]bool{uint16(localAddr.Port): true}
+	conns := []net.PacketConn{conn}
+	ports := []uint16{uint16(localAddr.Port)}
+	for _, portRange := range s.portRanges {
+		for port := portRange.Start; ; port++ {
+			if !seenPorts[port] {
+				seenPorts[port] = true
+				extraConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localAddr.IP, Port: int(port)})
+				if err != nil {
+					for _, c := range conns[1:] {
+						_ = c.Close()
+					}
+					return nil, E.Cause(err, "listen port hopping port ", port)
+				}
+				conns = append(conns, extraConn)
+				ports = append(ports, port)
+			}
+			if port == portRange.End {
+				break
+			}
+		}
+	}
+	for i, c := range conns {
+		conns[i] = NewObfuscatorConn(c, s.obfuscator)
+	}
+	s.listenPorts = ports
+	if s.zeroRTTHandshake {
+		return qtls.MultiPortListenEarly(conns, s.tlsConfig, s.quicConfig)
+	}
+	return qtls.MultiPortListen(conns, s.tlsConfig, s.quicConfig)
+}
+
+// loopHop periodically narrows s.activePorts to a rotating subset of s.listenPorts, for
+// callers that advertise it in server-generated URLs. It does not affect which sockets
+// accept traffic; every bound port keeps working regardless of rotation.
+func (s *Service[U]) loopHop() {
+	ticker := time.NewTicker(s.hopInterval)
+	defer ticker.Stop()
+	const activeSubsetSize = 1
+	offset := 0
+	for {
+		select {
+		case <-ticker.C:
+			s.listenAccess.Lock()
+			size := activeSubsetSize
+			if size > len(s.listenPorts) {
+				size = len(s.listenPorts)
+			}
+			active := make([]uint16, size)
+			for i := range active {
+				active[i] = s.listenPorts[(offset+i)%len(s.listenPorts)]
+			}
+			offset = (offset + 1) % len(s.listenPorts)
+			s.activePorts = active
+			s.listenAccess.Unlock()
+		case <-s.hopDone:
+			return
+		}
+	}
+}
+
+// ListenPorts returns every UDP port this service is bound to, for observability.
+func (s *Service[U]) ListenPorts() []uint16 {
+	return s.listenPorts
+}
+
+// ActivePorts returns the rotating subset of ListenPorts currently advertised to new
+// clients, when HopInterval is configured. Without HopInterval it equals ListenPorts.
+func (s *Service[U]) ActivePorts() []uint16 {
+	s.listenAccess.Lock()
+	defer s.listenAccess.Unlock()
+	return s.activePorts
+}
+
+func localPort(conn net.PacketConn) uint16 {
+	if udpAddr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		return uint16(udpAddr.Port)
+	}
+	return 0
+}
+
 func (s *Service[U]) Close() error {
+	if s.hopDone != nil {
+		close(s.hopDone)
+	}
 	return common.Close(
 		s.quicListener,
 	)
@@ -179,12 +382,60 @@ func (s *Service[U]) handleConnection(connection *quic.Conn) {
 		connDone:   make(chan struct{}),
 		udpConnMap: make(map[uint32]*udpPacketConn),
 	}
+	session.touch()
 	httpServer := http3.Server{
 		Handler:        session,
 		StreamHijacker: session.handleStream0,
 	}
-	_ = httpServer.ServeQUICConn(connection)
-	_ = connection.CloseWithError(0, "")
+	if s.authTimeout > 0 {
+		authTimer := time.AfterFunc(s.authTimeout, func() {
+			if !session.isAuthenticated() {
+				session.closeWithError(E.New("authentication timeout"))
+			}
+		})
+		defer authTimer.Stop()
+	}
+	s.registerSession(session)
+	defer s.unregisterSession(session)
+	err := httpServer.ServeQUICConn(connection)
+	// ServeQUICConn returning is the only unconditional teardown signal a session has:
+	// it covers a clean client disconnect, a QUIC idle timeout, a network error, and a
+	// handshake that never completes, none of which otherwise call closeWithError. Close
+	// connDone here too so loopHeartbeat/loopUDPGC and the zeroRTTHandshake replay guard
+	// in handleStream don't wait on it forever.
+	if err == nil {
+		err = net.ErrClosed
+	}
+	session.closeWithError(err)
+}
+
+func (s *Service[U]) registerSession(session *serverSession[U]) {
+	s.sessionAccess.Lock()
+	defer s.sessionAccess.Unlock()
+	s.sessions[session] = struct{}{}
+}
+
+func (s *Service[U]) unregisterSession(session *serverSession[U]) {
+	s.sessionAccess.Lock()
+	defer s.sessionAccess.Unlock()
+	delete(s.sessions, session)
+}
+
+// CloseUser force-disconnects every active session authenticated as user, e.g. once a
+// quota is exhausted or a credential is revoked. Sessions that have not authenticated
+// yet are unaffected since they are not associated with any user.
+func (s *Service[U]) CloseUser(user U) {
+	s.sessionAccess.Lock()
+	sessions := make([]*serverSession[U], 0, len(s.sessions))
+	for session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.sessionAccess.Unlock()
+	for _, session := range sessions {
+		if session.isAuthenticated() && session.authUser == user {
+			session.closeWithError(E.New("closed by CloseUser"))
+		}
+	}
 }
 
 type serverSession[U comparable] struct {
@@ -194,15 +445,73 @@ type serverSession[U comparable] struct {
 	connAccess    sync.Mutex
 	connDone      chan struct{}
 	connErr       error
-	authenticated bool
+	authenticated atomic.Bool
 	authUser      U
 	udpAccess     sync.RWMutex
 	udpConnMap    map[uint32]*udpPacketConn
+	lastActive    atomic.Int64
+}
+
+func (s *serverSession[U]) isAuthenticated() bool {
+	return s.authenticated.Load()
+}
+
+// touch records activity (a stream open, a datagram, or an explicit PING) for the
+// Heartbeat idle check.
+func (s *serverSession[U]) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+// loopHeartbeat closes the session if Heartbeat-configured idle detection trips.
+func (s *serverSession[U]) loopHeartbeat() {
+	ticker := time.NewTicker(s.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if time.Since(time.Unix(0, s.lastActive.Load())) > 2*s.heartbeat {
+				s.closeWithError(context.DeadlineExceeded)
+				return
+			}
+		case <-s.connDone:
+			return
+		}
+	}
+}
+
+// loopUDPGC periodically evicts udpPacketConns idle longer than udpTimeout. It runs
+// whenever UDPTimeout is set, independently of Heartbeat, so idle UDP sessions are
+// still reclaimed on servers that don't enable the heartbeat feature.
+func (s *serverSession[U]) loopUDPGC() {
+	ticker := time.NewTicker(s.udpTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.sweepIdleUDP()
+		case <-s.connDone:
+			return
+		}
+	}
+}
+
+// sweepIdleUDP removes and closes udpPacketConns that have been idle longer than
+// udpTimeout, so long-lived servers don't accumulate them under heavy UDP fan-out.
+func (s *serverSession[U]) sweepIdleUDP() {
+	s.udpAccess.Lock()
+	defer s.udpAccess.Unlock()
+	for sessionID, conn := range s.udpConnMap {
+		if conn.Idle(s.udpTimeout) {
+			conn.Close()
+			delete(s.udpConnMap, sessionID)
+		}
+	}
 }
 
 func (s *serverSession[U]) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.touch()
 	if r.Method == http.MethodPost && r.Host == protocol.URLHost && r.URL.Path == protocol.URLPath {
-		if s.authenticated {
+		if s.isAuthenticated() {
 			protocol.AuthResponseToHeader(w.Header(), protocol.AuthResponse{
 				UDPEnabled: !s.udpDisabled,
 				Rx:         s.receiveBPS,
@@ -218,7 +527,7 @@ func (s *serverSession[U]) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		s.authUser = user
-		s.authenticated = true
+		s.authenticated.Store(true)
 		var rxAuto bool
 		if s.receiveBPS > 0 && s.ignoreClientBandwidth && request.Rx == 0 {
 			s.logger.Debug("process connection from ", r.RemoteAddr, ": BBR disabled by server")
@@ -251,6 +560,12 @@ func (s *serverSession[U]) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		if !s.udpDisabled {
 			go s.loopMessages()
+			if s.udpTimeout > 0 {
+				go s.loopUDPGC()
+			}
+		}
+		if s.heartbeat > 0 {
+			go s.loopHeartbeat()
 		}
 	} else {
 		s.masqueradeHandler.ServeHTTP(w, r)
@@ -258,9 +573,15 @@ func (s *serverSession[U]) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *serverSession[U]) handleStream0(frameType http3.FrameType, _ quic.ConnectionTracingID, stream *quic.Stream, err error) (bool, error) {
-	if !s.authenticated || err != nil {
+	if !s.isAuthenticated() || err != nil {
 		return false, nil
 	}
+	s.touch()
+	if frameType == protocol.FrameTypePing {
+		stream.CancelRead(0)
+		stream.Close()
+		return true, nil
+	}
 	if frameType != protocol.FrameTypeTCPRequest {
 		return false, nil
 	}
@@ -282,8 +603,23 @@ func (s *serverSession[U]) handleStream(stream *quic.Stream) error {
 	if err != nil {
 		return E.New("read TCP request")
 	}
+	if s.trafficTracker != nil {
+		if err = s.trafficTracker.AllowNewConnection(s.authUser); err != nil {
+			return E.Cause(err, "rejected by traffic tracker")
+		}
+	}
+	if s.zeroRTTHandshake {
+		// The TCP request itself may have arrived as replayable 0-RTT data; wait for
+		// the handshake to finish before acting on it, so a replayed CONNECT can't
+		// open a duplicate connection to the destination.
+		select {
+		case <-s.quicConn.HandshakeComplete():
+		case <-s.connDone:
+			return E.Cause(s.connErr, "connection closed before handshake completed")
+		}
+	}
 	ctx := auth.ContextWithUser(s.ctx, s.authUser)
-	_ = s.handler.NewConnection(ctx, &serverConn{Stream: stream}, M.Metadata{
+	_ = s.handler.NewConnection(ctx, &serverConn{Stream: stream, tracker: s.trafficTracker, user: s.authUser}, M.Metadata{
 		Source:      M.SocksaddrFromNet(s.quicConn.RemoteAddr()),
 		Destination: M.ParseSocksaddr(destinationString),
 	})
@@ -311,6 +647,8 @@ func (s *serverSession[U]) closeWithError(err error) {
 type serverConn struct {
 	*quic.Stream
 	responseWritten bool
+	tracker         TrafficTracker
+	user            any
 }
 
 func (c *serverConn) HandshakeFailure(err error) error {
@@ -335,6 +673,9 @@ func (c *serverConn) HandshakeSuccess() error {
 
 func (c *serverConn) Read(p []byte) (n int, err error) {
 	n, err = c.Stream.Read(p)
+	if n > 0 && c.tracker != nil {
+		c.tracker.PushRx(c.user, n)
+	}
 	return n, baderror.WrapQUIC(err)
 }
 
@@ -347,9 +688,15 @@ func (c *serverConn) Write(p []byte) (n int, err error) {
 		if err != nil {
 			return 0, baderror.WrapQUIC(err)
 		}
+		if c.tracker != nil {
+			c.tracker.PushTx(c.user, len(p))
+		}
 		return len(p), nil
 	}
 	n, err = c.Stream.Write(p)
+	if n > 0 && c.tracker != nil {
+		c.tracker.PushTx(c.user, n)
+	}
 	return n, baderror.WrapQUIC(err)
 }
 
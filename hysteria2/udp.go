@@ -0,0 +1,157 @@
+package hysteria2
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/metacubex/sing-quic/hysteria2/internal/protocol"
+	"github.com/metacubex/sing/common/auth"
+	"github.com/metacubex/sing/common/buf"
+	E "github.com/metacubex/sing/common/exceptions"
+	M "github.com/metacubex/sing/common/metadata"
+)
+
+// loopMessages relays QUIC datagrams to and from per-client-session udpPacketConns. A
+// client picks a session ID for each UDP "connection" it opens; the first message seen
+// for a session creates its udpPacketConn and hands it to Handler, subsequent ones are
+// delivered to the already-running one.
+func (s *serverSession[U]) loopMessages() {
+	for {
+		data, err := s.quicConn.ReceiveDatagram(s.ctx)
+		if err != nil {
+			return
+		}
+		s.touch()
+		message, ok := protocol.ParseUDPMessage(data)
+		if !ok {
+			continue
+		}
+		if s.trafficTracker != nil {
+			s.trafficTracker.PushRx(s.authUser, len(message.Data))
+		}
+		s.udpAccess.Lock()
+		conn, loaded := s.udpConnMap[message.SessionID]
+		if !loaded {
+			conn = newUDPPacketConn(s.quicConn, message.SessionID, s.trafficTracker, s.authUser)
+			s.udpConnMap[message.SessionID] = conn
+		}
+		s.udpAccess.Unlock()
+		if !loaded {
+			ctx := auth.ContextWithUser(s.ctx, s.authUser)
+			go func() {
+				if hErr := s.handler.NewPacketConnection(ctx, conn, M.Metadata{
+					Source: M.SocksaddrFromNet(s.quicConn.RemoteAddr()),
+				}); hErr != nil {
+					s.logger.Error(E.Cause(hErr, "handle UDP session"))
+				}
+			}()
+		}
+		conn.deliver(message)
+	}
+}
+
+// udpPacketConnSender is the narrow part of *quic.Conn a udpPacketConn needs, so it
+// doesn't have to take a type parameter of its own just to reach the session that
+// created it.
+type udpPacketConnSender interface {
+	SendDatagram([]byte) error
+}
+
+// udpPacketConn is the per-session end of a relayed UDP "connection": one is created
+// for each distinct session ID a client uses in its UDP datagrams, and handed to
+// Handler as an N.PacketConn.
+type udpPacketConn struct {
+	sender       udpPacketConnSender
+	sessionID    uint32
+	tracker      TrafficTracker
+	user         any
+	inbound      chan protocol.UDPMessage
+	closeOnce    sync.Once
+	closed       chan struct{}
+	lastActive   atomic.Int64
+	nextPacketID atomic.Uint32
+}
+
+func newUDPPacketConn(sender udpPacketConnSender, sessionID uint32, tracker TrafficTracker, user any) *udpPacketConn {
+	conn := &udpPacketConn{
+		sender:    sender,
+		sessionID: sessionID,
+		tracker:   tracker,
+		user:      user,
+		inbound:   make(chan protocol.UDPMessage, 64),
+		closed:    make(chan struct{}),
+	}
+	conn.touch()
+	return conn
+}
+
+func (c *udpPacketConn) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+// Idle reports whether no packet has been delivered to or sent from c for longer than
+// timeout, for serverSession.sweepIdleUDP.
+func (c *udpPacketConn) Idle(timeout time.Duration) bool {
+	return time.Since(time.Unix(0, c.lastActive.Load())) > timeout
+}
+
+// deliver hands an inbound message to whatever is reading c. It never blocks: a reader
+// too far behind loses packets rather than stalling the session's shared loopMessages
+// goroutine, the same tradeoff UDP itself makes.
+func (c *udpPacketConn) deliver(message protocol.UDPMessage) {
+	c.touch()
+	select {
+	case c.inbound <- message:
+	default:
+	}
+}
+
+func (c *udpPacketConn) ReadPacket(buffer *buf.Buffer) (M.Socksaddr, error) {
+	select {
+	case message := <-c.inbound:
+		_, err := buffer.Write(message.Data)
+		return M.ParseSocksaddr(message.Addr), err
+	case <-c.closed:
+		return M.Socksaddr{}, net.ErrClosed
+	}
+}
+
+func (c *udpPacketConn) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	message := protocol.UDPMessage{
+		SessionID: c.sessionID,
+		PacketID:  uint16(c.nextPacketID.Add(1)),
+		FragCount: 1,
+		Addr:      destination.String(),
+		Data:      buffer.Bytes(),
+	}
+	if c.tracker != nil {
+		c.tracker.PushTx(c.user, buffer.Len())
+	}
+	c.touch()
+	return c.sender.SendDatagram(protocol.WriteUDPMessage(message))
+}
+
+func (c *udpPacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *udpPacketConn) LocalAddr() net.Addr {
+	return M.Socksaddr{}
+}
+
+func (c *udpPacketConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (c *udpPacketConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (c *udpPacketConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
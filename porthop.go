@@ -0,0 +1,250 @@
+package qtls
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	tls "github.com/metacubex/utls"
+
+	"github.com/metacubex/quic-go"
+)
+
+// MultiPortListen demultiplexes several UDP sockets into a single logical net.PacketConn
+// and listens on it exactly like Listen. It exists for "port hopping" setups (e.g.
+// Hysteria2) where a client may send consecutive packets for the same QUIC connection
+// from different source ports, or to a different one of the server's bound ports.
+//
+// Without help, quic-go would see those packets as coming from/to a new network path,
+// which DisablePathManager is meant to avoid. MultiPortListen keeps the illusion of a
+// single stable path by remembering, per destination connection ID, the address a
+// session was first seen on and reporting that same address for every subsequent packet
+// belonging to it, while still routing outgoing packets to the client's current real
+// address and socket.
+func MultiPortListen(conns []net.PacketConn, tlsConfig *tls.Config, quicConfig *quic.Config) (Listener, error) {
+	return Listen(newMultiPortPacketConn(conns), tlsConfig, quicConfig)
+}
+
+// MultiPortListenEarly is MultiPortListen for ListenEarly: it accepts connections before
+// their TLS handshake completes, for 0-RTT.
+func MultiPortListenEarly(conns []net.PacketConn, tlsConfig *tls.Config, quicConfig *quic.Config) (Listener, error) {
+	return ListenEarly(newMultiPortPacketConn(conns), tlsConfig, quicConfig)
+}
+
+// defaultShortHeaderConnIDLength is used to read the destination connection ID out of
+// 1-RTT (short header) packets, whose header does not carry an explicit length. quic-go
+// does not expose the negotiated length to a net.PacketConn wrapper, so we assume the
+// length it generates by default; connections using a different length merely lose path
+// stability across a hop, they are not otherwise affected.
+const defaultShortHeaderConnIDLength = 8
+
+type multiPortResult struct {
+	data []byte
+	addr net.Addr
+	conn net.PacketConn
+	err  error
+}
+
+type multiPortTarget struct {
+	conn net.PacketConn
+	addr net.Addr
+}
+
+// dcidMappingIdleTimeout bounds how long a stableByDCID/targetByAddr entry can go
+// without a packet before dcidGCInterval reclaims it. It is a small multiple of
+// typical QUIC idle timeouts so a live connection never loses path stability, while a
+// connection ID that the peer has retired or abandoned does not linger forever.
+const dcidMappingIdleTimeout = 5 * time.Minute
+
+const dcidGCInterval = time.Minute
+
+type multiPortPacketConn struct {
+	conns     []net.PacketConn
+	results   chan multiPortResult
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	mu           sync.Mutex
+	stableByDCID map[string]net.Addr
+	targetByAddr map[string]multiPortTarget
+	lastSeen     map[string]time.Time
+}
+
+func newMultiPortPacketConn(conns []net.PacketConn) *multiPortPacketConn {
+	c := &multiPortPacketConn{
+		conns:        conns,
+		results:      make(chan multiPortResult, len(conns)),
+		closed:       make(chan struct{}),
+		stableByDCID: make(map[string]net.Addr),
+		targetByAddr: make(map[string]multiPortTarget),
+		lastSeen:     make(map[string]time.Time),
+	}
+	for _, conn := range conns {
+		go c.readLoop(conn)
+	}
+	go c.gcLoop()
+	return c
+}
+
+// gcLoop periodically evicts stableByDCID/targetByAddr entries for connection IDs that
+// have gone quiet, so a long-running port-hopping server does not accumulate one entry
+// per connection ID ever seen for its entire lifetime.
+func (c *multiPortPacketConn) gcLoop() {
+	ticker := time.NewTicker(dcidGCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.sweepIdleDCIDs()
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *multiPortPacketConn) sweepIdleDCIDs() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for dcid, seen := range c.lastSeen {
+		if now.Sub(seen) < dcidMappingIdleTimeout {
+			continue
+		}
+		if stableAddr, ok := c.stableByDCID[dcid]; ok {
+			delete(c.targetByAddr, stableAddr.String())
+			delete(c.stableByDCID, dcid)
+		}
+		delete(c.lastSeen, dcid)
+	}
+}
+
+func (c *multiPortPacketConn) readLoop(conn net.PacketConn) {
+	buffer := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			select {
+			case c.results <- multiPortResult{err: err}:
+			case <-c.closed:
+			}
+			return
+		}
+		data := make([]byte, n)
+		copy(data, buffer[:n])
+		select {
+		case c.results <- multiPortResult{data: data, addr: addr, conn: conn}:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *multiPortPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case result := <-c.results:
+		if result.err != nil {
+			return 0, nil, result.err
+		}
+		stableAddr := c.trackPacket(result.data, result.addr, result.conn)
+		return copy(p, result.data), stableAddr, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+// trackPacket records where a connection's packets are currently arriving from and
+// returns the stable address that should be reported to quic-go for it.
+func (c *multiPortPacketConn) trackPacket(data []byte, actualAddr net.Addr, actualConn net.PacketConn) net.Addr {
+	dcid, ok := extractDestConnID(data)
+	if !ok {
+		return actualAddr
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stableAddr, exists := c.stableByDCID[dcid]
+	if !exists {
+		stableAddr = actualAddr
+		c.stableByDCID[dcid] = stableAddr
+	}
+	c.targetByAddr[stableAddr.String()] = multiPortTarget{conn: actualConn, addr: actualAddr}
+	c.lastSeen[dcid] = time.Now()
+	return stableAddr
+}
+
+func (c *multiPortPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	target, ok := c.targetByAddr[addr.String()]
+	c.mu.Unlock()
+	if !ok {
+		// No packet observed for this address yet; fall back to the first socket.
+		return c.conns[0].WriteTo(p, addr)
+	}
+	return target.conn.WriteTo(p, target.addr)
+}
+
+func (c *multiPortPacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	c.mu.Lock()
+	c.stableByDCID = make(map[string]net.Addr)
+	c.targetByAddr = make(map[string]multiPortTarget)
+	c.lastSeen = make(map[string]time.Time)
+	c.mu.Unlock()
+	var firstErr error
+	for _, conn := range c.conns {
+		if err := conn.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (c *multiPortPacketConn) LocalAddr() net.Addr {
+	return c.conns[0].LocalAddr()
+}
+
+func (c *multiPortPacketConn) SetDeadline(t time.Time) error {
+	return c.forEachConn(func(conn net.PacketConn) error { return conn.SetDeadline(t) })
+}
+
+func (c *multiPortPacketConn) SetReadDeadline(t time.Time) error {
+	return c.forEachConn(func(conn net.PacketConn) error { return conn.SetReadDeadline(t) })
+}
+
+func (c *multiPortPacketConn) SetWriteDeadline(t time.Time) error {
+	return c.forEachConn(func(conn net.PacketConn) error { return conn.SetWriteDeadline(t) })
+}
+
+func (c *multiPortPacketConn) forEachConn(fn func(net.PacketConn) error) error {
+	var firstErr error
+	for _, conn := range c.conns {
+		if err := fn(conn); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// extractDestConnID best-effort parses the destination connection ID out of a QUIC
+// packet, long or short header, for use as a stable per-session map key.
+func extractDestConnID(data []byte) (string, bool) {
+	if len(data) < 1 {
+		return "", false
+	}
+	if data[0]&0x80 != 0 {
+		// Long header: flags(1) | version(4) | dcid len(1) | dcid.
+		if len(data) < 6 {
+			return "", false
+		}
+		dcidLen := int(data[5])
+		if len(data) < 6+dcidLen || dcidLen == 0 {
+			return "", false
+		}
+		return string(data[6 : 6+dcidLen]), true
+	}
+	if len(data) < 1+defaultShortHeaderConnIDLength {
+		return "", false
+	}
+	return string(data[1 : 1+defaultShortHeaderConnIDLength]), true
+}
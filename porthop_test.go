@@ -0,0 +1,160 @@
+package qtls
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeAddr is a minimal net.Addr for tests that only care about address identity.
+type fakeAddr string
+
+func (a fakeAddr) Network() string { return "udp" }
+func (a fakeAddr) String() string  { return string(a) }
+
+// fakePacketConn is a net.PacketConn stand-in that does nothing; tests only need
+// distinct, comparable instances to track which conn a packet was attributed to.
+type fakePacketConn struct {
+	name string
+}
+
+func (c *fakePacketConn) ReadFrom([]byte) (int, net.Addr, error) { return 0, nil, net.ErrClosed }
+func (c *fakePacketConn) WriteTo([]byte, net.Addr) (int, error)  { return 0, net.ErrClosed }
+func (c *fakePacketConn) Close() error                           { return nil }
+func (c *fakePacketConn) LocalAddr() net.Addr                    { return fakeAddr("") }
+func (c *fakePacketConn) SetDeadline(time.Time) error            { return nil }
+func (c *fakePacketConn) SetReadDeadline(time.Time) error        { return nil }
+func (c *fakePacketConn) SetWriteDeadline(time.Time) error       { return nil }
+
+func TestExtractDestConnIDLongHeader(t *testing.T) {
+	// flags (long header, 0x80 set) | version(4) | dcid len(1) | dcid
+	data := []byte{0xC0, 1, 0, 0, 0, 4, 'a', 'b', 'c', 'd'}
+	dcid, ok := extractDestConnID(data)
+	if !ok {
+		t.Fatal("extractDestConnID: got ok=false, want true")
+	}
+	if dcid != "abcd" {
+		t.Fatalf("dcid = %q, want %q", dcid, "abcd")
+	}
+}
+
+func TestExtractDestConnIDShortHeader(t *testing.T) {
+	// flags (short header, 0x80 clear) | dcid (defaultShortHeaderConnIDLength bytes)
+	data := append([]byte{0x40}, []byte("12345678")...)
+	dcid, ok := extractDestConnID(data)
+	if !ok {
+		t.Fatal("extractDestConnID: got ok=false, want true")
+	}
+	if dcid != "12345678" {
+		t.Fatalf("dcid = %q, want %q", dcid, "12345678")
+	}
+}
+
+func TestExtractDestConnIDTooShort(t *testing.T) {
+	cases := [][]byte{
+		{},
+		{0xC0, 1, 0, 0, 0, 8, 'a'},              // long header, claims 8-byte dcid but only has 1
+		append([]byte{0x40}, []byte("1234")...), // short header, fewer than 8 bytes
+	}
+	for i, data := range cases {
+		if _, ok := extractDestConnID(data); ok {
+			t.Fatalf("case %d: extractDestConnID(%v): got ok=true, want false", i, data)
+		}
+	}
+}
+
+func newTestMultiPortPacketConn() *multiPortPacketConn {
+	return &multiPortPacketConn{
+		closed:       make(chan struct{}),
+		stableByDCID: make(map[string]net.Addr),
+		targetByAddr: make(map[string]multiPortTarget),
+		lastSeen:     make(map[string]time.Time),
+	}
+}
+
+func TestTrackPacketKeepsStableAddrAcrossMigration(t *testing.T) {
+	c := newTestMultiPortPacketConn()
+	data := []byte{0xC0, 1, 0, 0, 0, 4, 'd', 'c', 'i', 'd'}
+	connA := &fakePacketConn{name: "a"}
+	connB := &fakePacketConn{name: "b"}
+
+	firstAddr := c.trackPacket(data, fakeAddr("10.0.0.1:1000"), connA)
+	if firstAddr != fakeAddr("10.0.0.1:1000") {
+		t.Fatalf("first packet: stable addr = %v, want the source addr", firstAddr)
+	}
+
+	// The client hops to a new source port/socket; the DCID is the same, so the
+	// previously assigned stable address must still be returned.
+	secondAddr := c.trackPacket(data, fakeAddr("10.0.0.1:2000"), connB)
+	if secondAddr != firstAddr {
+		t.Fatalf("second packet: stable addr = %v, want %v (unchanged)", secondAddr, firstAddr)
+	}
+
+	c.mu.Lock()
+	target, ok := c.targetByAddr[firstAddr.String()]
+	c.mu.Unlock()
+	if !ok {
+		t.Fatal("targetByAddr has no entry for the stable address")
+	}
+	if target.addr != fakeAddr("10.0.0.1:2000") || target.conn != connB {
+		t.Fatalf("targetByAddr not updated to the migrated address/conn: got %+v", target)
+	}
+}
+
+func TestTrackPacketWithoutDCIDUsesActualAddr(t *testing.T) {
+	c := newTestMultiPortPacketConn()
+	addr := c.trackPacket(nil, fakeAddr("10.0.0.1:1000"), &fakePacketConn{})
+	if addr != fakeAddr("10.0.0.1:1000") {
+		t.Fatalf("stable addr = %v, want the actual addr unchanged", addr)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.stableByDCID) != 0 {
+		t.Fatalf("stableByDCID should stay empty without a parseable DCID, got %v", c.stableByDCID)
+	}
+}
+
+func TestSweepIdleDCIDsEvictsOnlyExpiredEntries(t *testing.T) {
+	c := newTestMultiPortPacketConn()
+	conn := &fakePacketConn{}
+
+	c.stableByDCID["fresh"] = fakeAddr("10.0.0.1:1")
+	c.targetByAddr["10.0.0.1:1"] = multiPortTarget{conn: conn, addr: fakeAddr("10.0.0.1:1")}
+	c.lastSeen["fresh"] = time.Now()
+
+	c.stableByDCID["stale"] = fakeAddr("10.0.0.1:2")
+	c.targetByAddr["10.0.0.1:2"] = multiPortTarget{conn: conn, addr: fakeAddr("10.0.0.1:2")}
+	c.lastSeen["stale"] = time.Now().Add(-2 * dcidMappingIdleTimeout)
+
+	c.sweepIdleDCIDs()
+
+	if _, ok := c.stableByDCID["fresh"]; !ok {
+		t.Fatal("fresh DCID entry was evicted, want it kept")
+	}
+	if _, ok := c.lastSeen["fresh"]; !ok {
+		t.Fatal("fresh lastSeen entry was evicted, want it kept")
+	}
+	if _, ok := c.stableByDCID["stale"]; ok {
+		t.Fatal("stale DCID entry was not evicted")
+	}
+	if _, ok := c.targetByAddr["10.0.0.1:2"]; ok {
+		t.Fatal("stale targetByAddr entry was not evicted")
+	}
+	if _, ok := c.lastSeen["stale"]; ok {
+		t.Fatal("stale lastSeen entry was not evicted")
+	}
+}
+
+func TestCloseClearsDCIDMappings(t *testing.T) {
+	c := newTestMultiPortPacketConn()
+	c.conns = []net.PacketConn{&fakePacketConn{}}
+	c.stableByDCID["dcid"] = fakeAddr("10.0.0.1:1")
+	c.targetByAddr["10.0.0.1:1"] = multiPortTarget{conn: &fakePacketConn{}, addr: fakeAddr("10.0.0.1:1")}
+	c.lastSeen["dcid"] = time.Now()
+
+	_ = c.Close()
+
+	if len(c.stableByDCID) != 0 || len(c.targetByAddr) != 0 || len(c.lastSeen) != 0 {
+		t.Fatal("Close did not clear the DCID mapping tables")
+	}
+}